@@ -0,0 +1,143 @@
+// Copyright 2016-2017 Percona LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/go-sql-driver/mysql"
+	"gopkg.in/yaml.v2"
+)
+
+// TLSConfig holds the TLS settings used to connect to a ProxySQL admin interface.
+type TLSConfig struct {
+	CAFile             string `yaml:"ca_file,omitempty"`
+	CertFile           string `yaml:"cert_file,omitempty"`
+	KeyFile            string `yaml:"key_file,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"`
+}
+
+// AuthModule describes how to reach a ProxySQL admin interface: the credentials
+// and connection method a /probe request selects by name, so raw DSNs never
+// need to appear in the Prometheus scrape configuration.
+type AuthModule struct {
+	User     string    `yaml:"user"`
+	Password string    `yaml:"password"`
+	Socket   string    `yaml:"socket,omitempty"`
+	TLS      TLSConfig `yaml:"tls,omitempty"`
+}
+
+// Config is the structure of the file passed via --config.file.
+type Config struct {
+	AuthModules map[string]AuthModule `yaml:"auth_modules"`
+}
+
+// SafeConfig wraps a Config so it can be reloaded from disk on SIGHUP while
+// /probe requests are being served concurrently.
+type SafeConfig struct {
+	mu sync.RWMutex
+	c  *Config
+}
+
+// ReloadConfig reads the config file at path and, if it parses successfully,
+// atomically swaps it in. An error leaves the previously loaded config in place.
+func (sc *SafeConfig) ReloadConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file %q: %s", path, err)
+	}
+
+	var c Config
+	if err := yaml.UnmarshalStrict(data, &c); err != nil {
+		return fmt.Errorf("error parsing config file %q: %s", path, err)
+	}
+
+	sc.mu.Lock()
+	sc.c = &c
+	sc.mu.Unlock()
+	return nil
+}
+
+// DSN builds the go-sql-driver/mysql DSN used to reach target through the
+// named auth module.
+func (sc *SafeConfig) DSN(moduleName, target string) (string, error) {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+
+	if sc.c == nil {
+		return "", fmt.Errorf("no config loaded")
+	}
+
+	module, ok := sc.c.AuthModules[moduleName]
+	if !ok {
+		return "", fmt.Errorf("auth_module %q not found in config file", moduleName)
+	}
+
+	cfg := mysql.NewConfig()
+	cfg.User = module.User
+	cfg.Passwd = module.Password
+	if module.Socket != "" {
+		cfg.Net = "unix"
+		cfg.Addr = module.Socket
+	} else {
+		cfg.Net = "tcp"
+		cfg.Addr = target
+	}
+
+	if module.TLS.CAFile != "" || module.TLS.CertFile != "" || module.TLS.InsecureSkipVerify {
+		tlsName := "probe-" + moduleName
+		tlsConfig, err := newTLSConfig(&module.TLS)
+		if err != nil {
+			return "", fmt.Errorf("error building tls config for auth_module %q: %s", moduleName, err)
+		}
+		if err := mysql.RegisterTLSConfig(tlsName, tlsConfig); err != nil {
+			return "", fmt.Errorf("error registering tls config for auth_module %q: %s", moduleName, err)
+		}
+		cfg.TLSConfig = tlsName
+	}
+
+	return cfg.FormatDSN(), nil
+}
+
+// newTLSConfig builds a *tls.Config from a TLSConfig.
+func newTLSConfig(c *TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+
+	if c.CAFile != "" {
+		caCert, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading ca_file: %s", err)
+		}
+		certPool := x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("failed to parse ca_file %q", c.CAFile)
+		}
+		tlsConfig.RootCAs = certPool
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2016-2017 Percona LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	timeoutOffset = flag.Float64("exporter.timeout-offset", 0.25,
+		"Offset to subtract from the Prometheus-supplied scrape timeout, in seconds.")
+	maxOpenConns = flag.Int("exporter.max-open-conns", 3,
+		"Maximum number of open connections to the ProxySQL admin interface.")
+	maxIdleConns = flag.Int("exporter.max-idle-conns", 3,
+		"Maximum number of idle connections to the ProxySQL admin interface.")
+	maxConnLifetime = flag.Duration("exporter.max-conn-lifetime", time.Minute,
+		"Maximum amount of time a connection to the ProxySQL admin interface may be reused.")
+)
+
+// openDB opens a connection pool to the ProxySQL admin interface at dsn,
+// bounded so a stuck admin interface can't wedge the exporter across scrapes.
+func openDB(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(*maxOpenConns)
+	db.SetMaxIdleConns(*maxIdleConns)
+	db.SetConnMaxLifetime(*maxConnLifetime)
+	return db, nil
+}
+
+// scrapeTimeout derives the per-scrape timeout from the
+// X-Prometheus-Scrape-Timeout-Seconds header Prometheus sends, minus
+// --exporter.timeout-offset. It returns 0 (no timeout) if the header is
+// absent, invalid, or the offset would leave nothing to work with.
+func scrapeTimeout(r *http.Request) time.Duration {
+	s := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if s == "" {
+		return 0
+	}
+
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0
+	}
+
+	seconds -= *timeoutOffset
+	if seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
@@ -0,0 +1,485 @@
+// Copyright 2016-2017 Percona LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	namespace = "proxysql"
+
+	mySQLGlobalQuery = `
+		SELECT Variable_Name, Variable_Value
+		  FROM stats_mysql_global
+	`
+
+	mySQLconnectionPoolQuery = `
+		SELECT hostgroup, srv_host, srv_port, status, ConnUsed, ConnFree, ConnOK, ConnERR,
+		       Queries, Bytes_data_sent, Bytes_data_recv, Latency_us
+		  FROM stats_mysql_connection_pool
+	`
+
+	mySQLConnectionListQuery = `
+		SELECT cli_host, srv_host
+		  FROM stats_mysql_processlist
+	`
+
+	// stats_mysql_processlist (and the rest of ProxySQL's admin interface) is
+	// served by ProxySQL's embedded SQLite3, not MySQL, despite speaking the
+	// MySQL wire protocol: only functions SQLite3 actually has may be used
+	// here, so host truncation and aggregation are done in Go below instead
+	// of with a MySQL builtin like SUBSTRING_INDEX.
+	mySQLProcesslistDetailQuery = `
+		SELECT user, cli_host, command, state, time
+		  FROM stats_mysql_processlist
+		 WHERE time >= ?
+	`
+)
+
+// metric describes a single ProxySQL status counter or gauge.
+type metric struct {
+	name      string
+	valueType prometheus.ValueType
+	help      string
+}
+
+// mySQLGlobalMetrics is a map of known stats_mysql_global variables, keyed by their
+// lowercased name. Variables not present here are still exported, but as untyped metrics.
+var mySQLGlobalMetrics = map[string]*metric{
+	"active_transactions":          {"active_transactions", prometheus.GaugeValue, "The number of client connections that are currently processing a transaction."},
+	"client_connections_aborted":   {"client_connections_aborted", prometheus.CounterValue, "The total number of frontend connections aborted."},
+	"client_connections_connected": {"client_connections_connected", prometheus.GaugeValue, "The number of frontend connections currently connected."},
+	"client_connections_created":   {"client_connections_created", prometheus.CounterValue, "The total number of frontend connections created."},
+}
+
+// mySQLconnectionPoolMetrics is a map of known stats_mysql_connection_pool columns,
+// keyed by their lowercased name. Unknown columns fall back to untyped metrics.
+var mySQLconnectionPoolMetrics = map[string]*metric{
+	"status":          {"status", prometheus.GaugeValue, "The status of the backend server (1 - ONLINE, 2 - SHUNNED, 3 - OFFLINE_SOFT, 4 - OFFLINE_HARD)."},
+	"conn_used":       {"conn_used", prometheus.GaugeValue, "The number of connections currently used by ProxySQL for sending queries to the backend server."},
+	"conn_free":       {"conn_free", prometheus.GaugeValue, "The number of connections currently free."},
+	"conn_ok":         {"conn_ok", prometheus.CounterValue, "The number of connections successfully established with the backend server."},
+	"conn_err":        {"conn_err", prometheus.CounterValue, "The number of connections attempted to be established with the backend server that failed."},
+	"queries":         {"queries", prometheus.CounterValue, "The number of queries routed towards this particular backend server."},
+	"bytes_data_sent": {"bytes_data_sent", prometheus.CounterValue, "The amount of data sent to the backend server."},
+	"bytes_data_recv": {"bytes_data_recv", prometheus.CounterValue, "The amount of data received from the backend server."},
+	"latency_us":      {"latency_us", prometheus.GaugeValue, "The currently ping time in microseconds, as reported from Monitor."},
+}
+
+// mySQLconnectionPoolStatus maps the textual status reported by ProxySQL to the
+// numeric value exported in the proxysql_connection_pool_status metric.
+var mySQLconnectionPoolStatus = map[string]float64{
+	"ONLINE":       1,
+	"SHUNNED":      2,
+	"OFFLINE_SOFT": 3,
+	"OFFLINE_HARD": 4,
+}
+
+// mySQLconnectionListMetrics describes the metrics exported from stats_mysql_processlist.
+var mySQLconnectionListMetrics = map[string]*metric{
+	"client_connection_list": {"client_connection_list", prometheus.GaugeValue, "Client connections connected to ProxySQL."},
+	"server_connection_list": {"server_connection_list", prometheus.GaugeValue, "Server connections opened by ProxySQL."},
+}
+
+// mySQLProcesslistDetailMetrics describes the metrics exported by
+// scrapeMySQLProcesslistDetail, aggregated from stats_mysql_processlist.
+var mySQLProcesslistDetailMetrics = map[string]*metric{
+	"threads": {"threads", prometheus.GaugeValue,
+		"Number of threads in this user/host/command/state combination on stats_mysql_processlist."},
+	"threads_seconds": {"threads_seconds", prometheus.GaugeValue,
+		"Total elapsed time in seconds of threads in this user/host/command/state combination."},
+}
+
+// scrapeCollectorDurationDesc and scrapeCollectorSuccessDesc report, per Scraper,
+// how long it took and whether it succeeded on the most recent scrape.
+var (
+	scrapeCollectorDurationDesc = prometheus.NewDesc(
+		newFqName("exporter", "collector_duration_seconds"),
+		"Collector time duration.",
+		[]string{"collector"}, nil,
+	)
+	scrapeCollectorSuccessDesc = prometheus.NewDesc(
+		newFqName("exporter", "collector_success"),
+		"Whether a collector succeeded.",
+		[]string{"collector"}, nil,
+	)
+	upDesc = prometheus.NewDesc(
+		newFqName("", "up"),
+		"Whether the last scrape of this collector against ProxySQL succeeded.",
+		[]string{"collector"}, nil,
+	)
+)
+
+// Exporter collects ProxySQL metrics. It implements prometheus.Collector.
+// The caller owns db: it must already be open and configured, and remains
+// the caller's responsibility to close.
+//
+// An Exporter's accounting metrics (scrapes_total, scrape_errors_total, ...)
+// are meant to be long-lived: construct one Exporter per target and reuse it
+// across scrapes, rather than rebuilding it per request, or the counters
+// reset to zero every time and rate()/increase() over them becomes
+// meaningless. Use CollectScrapers to vary the scraper subset or timeout on
+// a given scrape without losing that history.
+type Exporter struct {
+	db       *sql.DB
+	scrapers []Scraper
+	timeout  time.Duration // zero means no per-scrape timeout
+	logger   *slog.Logger
+
+	duration, error prometheus.Gauge
+	totalScrapes    prometheus.Counter
+	scrapeErrors    *prometheus.CounterVec
+
+	lastError uint32 // accessed atomically; 1 if the last scrape errored
+}
+
+// NewExporter returns a new ProxySQL exporter running the given set of
+// scrapers against db on each scrape. If timeout is non-zero, each scrape is
+// aborted after timeout elapses.
+func NewExporter(db *sql.DB, scrapers []Scraper, timeout time.Duration, logger *slog.Logger) *Exporter {
+	return &Exporter{
+		db:       db,
+		scrapers: scrapers,
+		timeout:  timeout,
+		logger:   logger,
+
+		duration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "last_scrape_duration_seconds",
+			Help:      "Duration of the last scrape of metrics from ProxySQL.",
+		}),
+		error: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "last_scrape_error",
+			Help:      "Whether the last scrape of metrics from ProxySQL resulted in an error (1 for error, 0 for success).",
+		}),
+		totalScrapes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "scrapes_total",
+			Help:      "Total number of times ProxySQL was scraped for metrics.",
+		}),
+		scrapeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "scrape_errors_total",
+			Help:      "Total number of times an error occurred scraping a ProxySQL.",
+		}, []string{"collector"}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- e.duration.Desc()
+	ch <- e.error.Desc()
+	ch <- e.totalScrapes.Desc()
+	e.scrapeErrors.Describe(ch)
+}
+
+// Collect implements prometheus.Collector, scraping with e's configured
+// scrapers and timeout.
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.CollectScrapers(ch, e.scrapers, e.timeout)
+}
+
+// CollectScrapers scrapes with the given scrapers and timeout instead of e's
+// configured defaults, while still updating e's persistent accounting
+// metrics. This lets a single long-lived Exporter serve requests that vary
+// the collect[] scraper subset or timeout without resetting its scrape
+// history on every call.
+func (e *Exporter) CollectScrapers(ch chan<- prometheus.Metric, scrapers []Scraper, timeout time.Duration) {
+	e.scrape(ch, scrapers, timeout)
+
+	ch <- e.duration
+	ch <- e.error
+	ch <- e.totalScrapes
+	e.scrapeErrors.Collect(ch)
+}
+
+// Error reports whether the most recent scrape ended in an error.
+func (e *Exporter) Error() bool {
+	return atomic.LoadUint32(&e.lastError) == 1
+}
+
+func (e *Exporter) scrape(ch chan<- prometheus.Metric, scrapers []Scraper, timeout time.Duration) {
+	e.totalScrapes.Inc()
+
+	var err error
+	defer func(begin time.Time) {
+		e.duration.Set(time.Since(begin).Seconds())
+		if err != nil {
+			e.error.Set(1)
+			atomic.StoreUint32(&e.lastError, 1)
+		} else {
+			e.error.Set(0)
+			atomic.StoreUint32(&e.lastError, 0)
+		}
+	}(time.Now())
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	for _, scraper := range scrapers {
+		scraperStart := time.Now()
+		scrapeErr := scraper.Scrape(ctx, e.db, ch, e.logger)
+		scraperDuration := time.Since(scraperStart).Seconds()
+
+		success := 1.0
+		if scrapeErr != nil {
+			e.logger.Error("Error scraping collector", "collector", scraper.Name(), "err", scrapeErr)
+			e.scrapeErrors.WithLabelValues(scraper.Name()).Inc()
+			err = scrapeErr
+			success = 0
+		}
+
+		ch <- prometheus.MustNewConstMetric(scrapeCollectorDurationDesc, prometheus.GaugeValue, scraperDuration, scraper.Name())
+		ch <- prometheus.MustNewConstMetric(scrapeCollectorSuccessDesc, prometheus.GaugeValue, success, scraper.Name())
+		ch <- prometheus.MustNewConstMetric(upDesc, prometheus.GaugeValue, success, scraper.Name())
+	}
+}
+
+// newFqName returns the fully qualified metric name for the given subsystem/name pair.
+func newFqName(subsystem, name string) string {
+	return prometheus.BuildFQName(namespace, subsystem, name)
+}
+
+// parseStatus converts a raw stats_mysql_global/stats_mysql_connection_pool value into
+// a float64, reporting whether the conversion succeeded.
+func parseStatus(value sql.RawBytes) (float64, bool) {
+	if f, err := strconv.ParseFloat(string(value), 64); err == nil {
+		return f, true
+	}
+	return 0, false
+}
+
+// scrapeMySQLGlobal collects from stats_mysql_global.
+func scrapeMySQLGlobal(ctx context.Context, db *sql.DB, ch chan<- prometheus.Metric, logger *slog.Logger) error {
+	logger.Debug("Scraping stats_mysql_global")
+	rows, err := db.QueryContext(ctx, mySQLGlobalQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var key string
+	var val sql.RawBytes
+
+	for rows.Next() {
+		if err := rows.Scan(&key, &val); err != nil {
+			return err
+		}
+		key = strings.ToLower(key)
+
+		floatVal, ok := parseStatus(val)
+		if !ok {
+			continue
+		}
+
+		if m, ok := mySQLGlobalMetrics[key]; ok {
+			ch <- prometheus.MustNewConstMetric(
+				prometheus.NewDesc(newFqName("mysql_status", m.name), m.help, nil, nil),
+				m.valueType, floatVal,
+			)
+		} else {
+			ch <- prometheus.MustNewConstMetric(
+				prometheus.NewDesc(newFqName("mysql_status", key), "Average statistics from stats_mysql_global.", nil, nil),
+				prometheus.UntypedValue, floatVal,
+			)
+		}
+	}
+	return rows.Err()
+}
+
+// scrapeMySQLConnectionPool collects from stats_mysql_connection_pool.
+func scrapeMySQLConnectionPool(ctx context.Context, db *sql.DB, ch chan<- prometheus.Metric, logger *slog.Logger) error {
+	logger.Debug("Scraping stats_mysql_connection_pool")
+	rows, err := db.QueryContext(ctx, mySQLconnectionPoolQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var hostgroup, srvHost, srvPort, status string
+	var connUsed, connFree, connOK, connERR, queries, bytesDataSent, bytesDataRecv, latencyUs float64
+
+	for rows.Next() {
+		if err := rows.Scan(&hostgroup, &srvHost, &srvPort, &status,
+			&connUsed, &connFree, &connOK, &connERR,
+			&queries, &bytesDataSent, &bytesDataRecv, &latencyUs); err != nil {
+			return err
+		}
+
+		endpoint := srvHost + ":" + srvPort
+		labels := []string{"hostgroup", "endpoint"}
+		labelValues := []string{hostgroup, endpoint}
+
+		statusValue, ok := mySQLconnectionPoolStatus[status]
+		if !ok {
+			statusValue = 0
+		}
+
+		values := map[string]float64{
+			"status":          statusValue,
+			"conn_used":       connUsed,
+			"conn_free":       connFree,
+			"conn_ok":         connOK,
+			"conn_err":        connERR,
+			"queries":         queries,
+			"bytes_data_sent": bytesDataSent,
+			"bytes_data_recv": bytesDataRecv,
+			"latency_us":      latencyUs,
+		}
+
+		for _, key := range []string{"status", "conn_used", "conn_free", "conn_ok", "conn_err",
+			"queries", "bytes_data_sent", "bytes_data_recv", "latency_us"} {
+			v := values[key]
+			if m, ok := mySQLconnectionPoolMetrics[key]; ok && m.name != "" {
+				ch <- prometheus.MustNewConstMetric(
+					prometheus.NewDesc(newFqName("connection_pool", m.name), m.help, labels, nil),
+					m.valueType, v, labelValues...,
+				)
+			} else {
+				ch <- prometheus.MustNewConstMetric(
+					prometheus.NewDesc(newFqName("connection_pool", key), "Statistics from stats_mysql_connection_pool.", labels, nil),
+					prometheus.UntypedValue, v, labelValues...,
+				)
+			}
+		}
+	}
+	return rows.Err()
+}
+
+// scrapeMySQLConnectionList collects from stats_mysql_processlist, exposing the number
+// of connections per client and per server host.
+func scrapeMySQLConnectionList(ctx context.Context, db *sql.DB, ch chan<- prometheus.Metric, logger *slog.Logger) error {
+	logger.Debug("Scraping stats_mysql_processlist")
+	rows, err := db.QueryContext(ctx, mySQLConnectionListQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	clientConns := make(map[string]int)
+	serverConns := make(map[string]int)
+
+	var cliHost, srvHost string
+	for rows.Next() {
+		if err := rows.Scan(&cliHost, &srvHost); err != nil {
+			return err
+		}
+		clientConns[cliHost]++
+		serverConns[srvHost]++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for host, count := range clientConns {
+		ch <- connectionListMetric("client_connection_list", "client_host", host, float64(count))
+	}
+	for host, count := range serverConns {
+		ch <- connectionListMetric("server_connection_list", "server_host", host, float64(count))
+	}
+	return nil
+}
+
+// connectionListMetric builds a single client/server connection count metric, falling
+// back to a generic gauge if key is missing from mySQLconnectionListMetrics.
+func connectionListMetric(key, label, value string, count float64) prometheus.Metric {
+	name, help, valueType := key, "Number of connections from stats_mysql_processlist.", prometheus.GaugeValue
+	if m, ok := mySQLconnectionListMetrics[key]; ok && m.name != "" {
+		name, help, valueType = m.name, m.help, m.valueType
+	}
+	return prometheus.MustNewConstMetric(
+		prometheus.NewDesc(newFqName("processlist", name), help, []string{label}, nil),
+		valueType, count, value,
+	)
+}
+
+// processlistDetailKey groups threads by user, client host (port stripped),
+// command and state, mirroring mysqld_exporter's info_schema.processlist collector.
+type processlistDetailKey struct {
+	user, host, command, state string
+}
+
+// scrapeMySQLProcesslistDetail collects from stats_mysql_processlist, grouping
+// and truncating cli_host to its hostname in Go rather than in SQL, since
+// ProxySQL's admin interface runs on SQLite3 and has no SUBSTRING_INDEX.
+// Threads whose elapsed time is below minTime are excluded by the query itself.
+func scrapeMySQLProcesslistDetail(ctx context.Context, db *sql.DB, ch chan<- prometheus.Metric, logger *slog.Logger, minTime int) error {
+	logger.Debug("Scraping stats_mysql_processlist (detail)")
+	rows, err := db.QueryContext(ctx, mySQLProcesslistDetailQuery, minTime)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	threads := make(map[processlistDetailKey]float64)
+	seconds := make(map[processlistDetailKey]float64)
+
+	var user, cliHost, command, state string
+	var elapsed float64
+	for rows.Next() {
+		if err := rows.Scan(&user, &cliHost, &command, &state, &elapsed); err != nil {
+			return err
+		}
+
+		host := cliHost
+		if i := strings.IndexByte(cliHost, ':'); i >= 0 {
+			host = cliHost[:i]
+		}
+
+		key := processlistDetailKey{user, host, command, state}
+		threads[key]++
+		seconds[key] += elapsed
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for key, count := range threads {
+		labels := []string{"user", "host", "command", "state"}
+		labelValues := []string{key.user, key.host, key.command, key.state}
+
+		m := mySQLProcesslistDetailMetrics["threads"]
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc(newFqName("processlist", m.name), m.help, labels, nil),
+			m.valueType, count, labelValues...,
+		)
+
+		m = mySQLProcesslistDetailMetrics["threads_seconds"]
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc(newFqName("processlist", m.name), m.help, labels, nil),
+			m.valueType, seconds[key], labelValues...,
+		)
+	}
+	return nil
+}
@@ -15,7 +15,13 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
 	"regexp"
 	"strings"
 	"testing"
@@ -23,10 +29,14 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	"github.com/smartystreets/goconvey/convey"
 	"gopkg.in/DATA-DOG/go-sqlmock.v1"
 )
 
+// testLogger discards everything; tests assert on metrics, not log output.
+var testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
 var nameRE = regexp.MustCompile(`fqName: "(\w+)"`)
 
 // https://github.com/prometheus/client_golang/issues/322
@@ -75,6 +85,7 @@ func sanitizeQuery(q string) string {
 	q = strings.Replace(q, "(", "\\(", -1)
 	q = strings.Replace(q, ")", "\\)", -1)
 	q = strings.Replace(q, "*", "\\*", -1)
+	q = strings.Replace(q, "?", "\\?", -1)
 	return q
 }
 
@@ -104,7 +115,7 @@ func TestScrapeMySQLGlobal(t *testing.T) {
 
 	ch := make(chan prometheus.Metric)
 	go func() {
-		if err = scrapeMySQLGlobal(db, ch); err != nil {
+		if err = scrapeMySQLGlobal(context.Background(), db, ch, testLogger); err != nil {
 			t.Errorf("error calling function on test: %s", err)
 		}
 		close(ch)
@@ -142,7 +153,7 @@ func TestScrapeMySQLGlobalError(t *testing.T) {
 	ch1 := make(chan prometheus.Metric)
 
 	go func() {
-		scrapeMySQLGlobal(db1, ch1)
+		scrapeMySQLGlobal(context.Background(), db1, ch1, testLogger)
 		close(ch1)
 	}()
 
@@ -158,7 +169,7 @@ func TestScrapeMySQLGlobalError(t *testing.T) {
 
 	ch2 := make(chan prometheus.Metric)
 	go func() {
-		scrapeMySQLGlobal(db2, ch2)
+		scrapeMySQLGlobal(context.Background(), db2, ch2, testLogger)
 		close(ch2)
 	}()
 
@@ -190,7 +201,7 @@ func TestScrapeMySQLConnectionPool(t *testing.T) {
 
 	ch := make(chan prometheus.Metric)
 	go func() {
-		if err = scrapeMySQLConnectionPool(db, ch); err != nil {
+		if err = scrapeMySQLConnectionPool(context.Background(), db, ch, testLogger); err != nil {
 			t.Errorf("error calling function on test: %s", err)
 		}
 		close(ch)
@@ -261,7 +272,7 @@ func TestScrapeMySQLConnectionPoolError(t *testing.T) {
 	ch1 := make(chan prometheus.Metric)
 
 	go func() {
-		scrapeMySQLConnectionPool(db1, ch1)
+		scrapeMySQLConnectionPool(context.Background(), db1, ch1, testLogger)
 		close(ch1)
 	}()
 
@@ -286,7 +297,7 @@ func TestScrapeMySQLConnectionPoolError(t *testing.T) {
 
 	ch2 := make(chan prometheus.Metric)
 	go func() {
-		scrapeMySQLConnectionPool(db2, ch2)
+		scrapeMySQLConnectionPool(context.Background(), db2, ch2, testLogger)
 		close(ch2)
 	}()
 
@@ -317,7 +328,7 @@ func TestScrapeMySQLConnectionList(t *testing.T) {
 
 	ch := make(chan prometheus.Metric)
 	go func() {
-		if err = scrapeMySQLConnectionList(db, ch); err != nil {
+		if err = scrapeMySQLConnectionList(context.Background(), db, ch, testLogger); err != nil {
 			t.Errorf("error calling function on test: %s", err)
 		}
 		close(ch)
@@ -371,7 +382,7 @@ func TestScrapeMySQLConnectionListError(t *testing.T) {
 	ch1 := make(chan prometheus.Metric)
 
 	go func() {
-		scrapeMySQLConnectionList(db1, ch1)
+		scrapeMySQLConnectionList(context.Background(), db1, ch1, testLogger)
 		close(ch1)
 	}()
 
@@ -392,23 +403,252 @@ func TestScrapeMySQLConnectionListError(t *testing.T) {
 
 	ch2 := make(chan prometheus.Metric)
 	go func() {
-		scrapeMySQLConnectionList(db2, ch2)
+		scrapeMySQLConnectionList(context.Background(), db2, ch2, testLogger)
 		close(ch2)
 	}()
 
 	_ = *readMetric(<-ch2)
 }
 
+func TestScrapeMySQLProcesslistDetail(t *testing.T) {
+	convey.Convey("Metrics are lowercase", t, convey.FailureContinues, func(cv convey.C) {
+		for c, m := range mySQLProcesslistDetailMetrics {
+			cv.So(c, convey.ShouldEqual, strings.ToLower(c))
+			cv.So(m.name, convey.ShouldEqual, strings.ToLower(m.name))
+		}
+	})
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error opening a stub database connection: %s", err)
+	}
+	defer db.Close()
+
+	// Two rows share a user/command/state and a cli_host with different ports
+	// (10.91.142.80:55000, 10.91.142.80:55001), to verify the port is stripped
+	// and the two threads are aggregated together in Go.
+	columns := []string{"user", "cli_host", "command", "state", "time"}
+	rows := sqlmock.NewRows(columns).
+		AddRow("app", "10.91.142.80:55000", "Query", "", "5").
+		AddRow("app", "10.91.142.80:55001", "Query", "", "7.5").
+		AddRow("monitor", "10.91.142.82:55002", "Sleep", "", "0")
+	mock.ExpectQuery(sanitizeQuery(mySQLProcesslistDetailQuery)).WillReturnRows(rows)
+
+	ch := make(chan prometheus.Metric)
+	go func() {
+		if err = scrapeMySQLProcesslistDetail(context.Background(), db, ch, testLogger, 0); err != nil {
+			t.Errorf("error calling function on test: %s", err)
+		}
+		close(ch)
+	}()
+
+	counterExpected := []metricResult{
+		{"proxysql_processlist_threads", prometheus.Labels{"user": "app", "host": "10.91.142.80", "command": "Query", "state": ""}, 2, dto.MetricType_GAUGE},
+		{"proxysql_processlist_threads_seconds", prometheus.Labels{"user": "app", "host": "10.91.142.80", "command": "Query", "state": ""}, 12.5, dto.MetricType_GAUGE},
+		{"proxysql_processlist_threads", prometheus.Labels{"user": "monitor", "host": "10.91.142.82", "command": "Sleep", "state": ""}, 1, dto.MetricType_GAUGE},
+		{"proxysql_processlist_threads_seconds", prometheus.Labels{"user": "monitor", "host": "10.91.142.82", "command": "Sleep", "state": ""}, 0, dto.MetricType_GAUGE},
+	}
+
+	// Aggregation happens via a map, so groups arrive in indeterminate order;
+	// match each received metric against the expected set by name and labels.
+	var got []metricResult
+	for m := range ch {
+		got = append(got, *readMetric(m))
+	}
+	convey.Convey("Metrics comparison", t, convey.FailureContinues, func(cv convey.C) {
+		cv.So(got, convey.ShouldHaveLength, len(counterExpected))
+		for _, expect := range counterExpected {
+			cv.So(got, convey.ShouldContain, expect)
+		}
+	})
+
+	// Ensure all SQL queries were executed
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestScrapeMySQLProcesslistDetailError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error opening a stub database connection: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(sanitizeQuery(mySQLProcesslistDetailQuery)).WillReturnError(errors.New("an error"))
+
+	ch := make(chan prometheus.Metric, 1)
+	if err := scrapeMySQLProcesslistDetail(context.Background(), db, ch, testLogger, 0); err == nil {
+		t.Error("expected an error from scrapeMySQLProcesslistDetail, got nil")
+	}
+	close(ch)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestFilterScrapers(t *testing.T) {
+	all := newScrapers(0)
+	defaults := []Scraper{scraperMySQLStatus{}, scraperMySQLConnectionPool{}, scraperMySQLProcesslist{}}
+
+	convey.Convey("No collect[] parameters returns the defaults", t, func(cv convey.C) {
+		cv.So(filterScrapers(defaults, all, nil), convey.ShouldResemble, defaults)
+	})
+
+	convey.Convey("collect[] selects a subset by name", t, func(cv convey.C) {
+		cv.So(filterScrapers(defaults, all, []string{"mysql_status"}), convey.ShouldResemble, []Scraper{scraperMySQLStatus{}})
+	})
+
+	convey.Convey("Unknown names are ignored", t, func(cv convey.C) {
+		cv.So(filterScrapers(defaults, all, []string{"mysql_status", "bogus"}), convey.ShouldResemble, []Scraper{scraperMySQLStatus{}})
+	})
+}
+
+func TestFilteredScrapeOnlyRunsSelectedQueries(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error opening a stub database connection: %s", err)
+	}
+	defer db.Close()
+
+	rows := sqlmock.NewRows([]string{"Variable_Name", "Variable_Value"}).
+		AddRow("Active_Transactions", "3")
+	mock.ExpectQuery(sanitizeQuery(mySQLGlobalQuery)).WillReturnRows(rows)
+
+	all := newScrapers(0)
+	defaults := []Scraper{scraperMySQLStatus{}, scraperMySQLConnectionPool{}, scraperMySQLProcesslist{}}
+	selected := filterScrapers(defaults, all, []string{"mysql_status"})
+
+	ch := make(chan prometheus.Metric, 1)
+	for _, s := range selected {
+		if err := s.Scrape(context.Background(), db, ch, testLogger); err != nil {
+			t.Errorf("unexpected error from scraper %s: %s", s.Name(), err)
+		}
+	}
+	close(ch)
+	for range ch {
+	}
+
+	// Only stats_mysql_global was expected above; had the connection pool or
+	// processlist scrapers also run, this would fail with unmet expectations.
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestScrapeTimeoutAbortsQuery verifies that a scrape whose context expires
+// before the query returns is aborted cleanly: the scraper reports an error
+// instead of blocking forever.
+func TestScrapeTimeoutAbortsQuery(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error opening a stub database connection: %s", err)
+	}
+	defer db.Close()
+
+	columns := []string{"Variable_Name", "Variable_Value"}
+	rows := sqlmock.NewRows(columns).AddRow("Active_Transactions", "3")
+	mock.ExpectQuery(mySQLGlobalQuery).WillDelayFor(50 * time.Millisecond).WillReturnRows(rows)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+
+	ch := make(chan prometheus.Metric, 1)
+	err = scrapeMySQLGlobal(ctx, db, ch, testLogger)
+	close(ch)
+
+	if err == nil {
+		t.Fatal("expected scrapeMySQLGlobal to return an error when the context times out")
+	}
+}
+
+// TestExporterReportsScrapeError verifies that a failed scraper query flips
+// the proxysql_exporter_last_scrape_error gauge to 1.
+func TestExporterReportsScrapeError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error opening a stub database connection: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(mySQLGlobalQuery).WillReturnError(errors.New("an error"))
+
+	exporter := NewExporter(db, []Scraper{scraperMySQLStatus{}}, 0, testLogger)
+
+	ch := make(chan prometheus.Metric, 16)
+	exporter.Collect(ch)
+	close(ch)
+
+	var sawErrorGauge bool
+	for m := range ch {
+		got := readMetric(m)
+		if got.name == "proxysql_exporter_last_scrape_error" {
+			sawErrorGauge = true
+			if got.value != 1 {
+				t.Errorf("expected proxysql_exporter_last_scrape_error to be 1, got %v", got.value)
+			}
+		}
+	}
+	if !sawErrorGauge {
+		t.Fatal("expected proxysql_exporter_last_scrape_error metric to be emitted")
+	}
+
+	if !exporter.Error() {
+		t.Error("expected Exporter.Error() to report true")
+	}
+}
+
+// TestExporterTimeoutReportsError verifies that Exporter.Collect derives a
+// per-scrape context from its configured timeout and reports a failed scrape
+// (Error() == true, i.e. what Prometheus would see as up == 0) when a query
+// doesn't return before that timeout elapses.
+func TestExporterTimeoutReportsError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error opening a stub database connection: %s", err)
+	}
+	defer db.Close()
+
+	columns := []string{"Variable_Name", "Variable_Value"}
+	rows := sqlmock.NewRows(columns).AddRow("Active_Transactions", "3")
+	mock.ExpectQuery(mySQLGlobalQuery).WillDelayFor(50 * time.Millisecond).WillReturnRows(rows)
+
+	exporter := NewExporter(db, []Scraper{scraperMySQLStatus{}}, time.Millisecond, testLogger)
+
+	ch := make(chan prometheus.Metric, 16)
+	exporter.Collect(ch)
+	close(ch)
+	for range ch {
+	}
+
+	if !exporter.Error() {
+		t.Error("expected Exporter.Error() to report true after a timed-out scrape")
+	}
+}
+
+// TestExporter exercises the /probe endpoint end-to-end against a live ProxySQL,
+// the way Prometheus itself would scrape it via relabeling.
 func TestExporter(t *testing.T) {
 	if testing.Short() {
 		t.Skip("-short is passed, skipping integration test")
 	}
 
+	sc := &SafeConfig{c: &Config{
+		AuthModules: map[string]AuthModule{
+			"test": {User: "admin", Password: "admin"},
+		},
+	}}
+
 	// wait up to 30 seconds for ProxySQL to become available
-	exporter := NewExporter("admin:admin@tcp(127.0.0.1:16032)/", true, true, true)
+	db, err := sql.Open("mysql", "admin:admin@tcp(127.0.0.1:16032)/")
+	if err != nil {
+		t.Fatalf("error opening connection to ProxySQL: %s", err)
+	}
+	defer db.Close()
+
 	for i := 0; i < 30; i++ {
-		db, err := exporter.db()
-		if err != nil {
+		if err := db.Ping(); err != nil {
 			time.Sleep(time.Second)
 			continue
 		}
@@ -439,46 +679,88 @@ SAVE MYSQL USERS TO DISK;
 		break
 	}
 
-	convey.Convey("Metrics descriptions", t, convey.FailureContinues, func(cv convey.C) {
-		ch := make(chan *prometheus.Desc)
-		go func() {
-			exporter.Describe(ch)
-			close(ch)
-		}()
-
-		descs := make(map[string]struct{})
-		for d := range ch {
-			descs[d.String()] = struct{}{}
-		}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probeHandler(w, r, sc, newScrapers(0), testLogger)
+	}))
+	defer srv.Close()
 
-		cv.So(descs, convey.ShouldContainKey,
-			`Desc{fqName: "proxysql_connection_pool_latency_us", help: "The currently ping time in microseconds, as reported from Monitor.", constLabels: {}, variableLabels: [hostgroup endpoint]}`)
-	})
+	resp, err := http.Get(srv.URL + "/probe?target=127.0.0.1:16032&auth_module=test")
+	if err != nil {
+		t.Fatalf("error probing target: %s", err)
+	}
+	defer resp.Body.Close()
 
-	convey.Convey("Metrics data", t, convey.FailureContinues, func(cv convey.C) {
-		ch := make(chan prometheus.Metric)
-		go func() {
-			exporter.Collect(ch)
-			close(ch)
-		}()
-
-		var metrics []metricResult
-		for m := range ch {
-			got := *readMetric(m)
-			got.value = 0 // ignore actual values in comparison for now
-			metrics = append(metrics, got)
-		}
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		t.Fatalf("error parsing probe response: %s", err)
+	}
 
-		for _, m := range metrics {
-			cv.So(m.name, convey.ShouldEqual, strings.ToLower(m.name))
-			for k := range m.labels {
-				cv.So(k, convey.ShouldEqual, strings.ToLower(k))
+	convey.Convey("Probe response", t, convey.FailureContinues, func(cv convey.C) {
+		cv.So(families, convey.ShouldContainKey, "probe_success")
+		cv.So(families["probe_success"].GetMetric()[0].GetGauge().GetValue(), convey.ShouldEqual, 1)
+		cv.So(families, convey.ShouldContainKey, "probe_duration_seconds")
+		cv.So(families, convey.ShouldContainKey, "proxysql_connection_pool_latency_us")
+
+		var endpoints []string
+		for _, m := range families["proxysql_connection_pool_latency_us"].GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "endpoint" {
+					endpoints = append(endpoints, l.GetValue())
+				}
 			}
 		}
+		cv.So(endpoints, convey.ShouldContain, "mysql:3306")
+		cv.So(endpoints, convey.ShouldContain, "percona-server:3306")
+	})
+
+	// mysql_processlist_detail is off by default; probe it explicitly via
+	// collect[] to prove its query runs against ProxySQL's actual admin
+	// interface (SQLite3), not just a sqlmock regex match.
+	detailResp, err := http.Get(srv.URL + "/probe?target=127.0.0.1:16032&auth_module=test&collect[]=mysql_processlist_detail")
+	if err != nil {
+		t.Fatalf("error probing target: %s", err)
+	}
+	defer detailResp.Body.Close()
+
+	detailFamilies, err := parser.TextToMetricFamilies(detailResp.Body)
+	if err != nil {
+		t.Fatalf("error parsing probe response: %s", err)
+	}
 
-		cv.So(metricResult{"proxysql_connection_pool_latency_us", prometheus.Labels{"hostgroup": "1", "endpoint": "mysql:3306"}, 0, dto.MetricType_GAUGE},
-			convey.ShouldBeIn, metrics)
-		cv.So(metricResult{"proxysql_connection_pool_latency_us", prometheus.Labels{"hostgroup": "1", "endpoint": "percona-server:3306"}, 0, dto.MetricType_GAUGE},
-			convey.ShouldBeIn, metrics)
+	convey.Convey("Probe response with mysql_processlist_detail", t, convey.FailureContinues, func(cv convey.C) {
+		cv.So(detailFamilies, convey.ShouldContainKey, "probe_success")
+		cv.So(detailFamilies["probe_success"].GetMetric()[0].GetGauge().GetValue(), convey.ShouldEqual, 1)
 	})
 }
+
+// TestProbeHandlerValidation covers probeHandler's own request-validation
+// branches with no live ProxySQL involved, unlike TestExporter above.
+func TestProbeHandlerValidation(t *testing.T) {
+	sc := &SafeConfig{c: &Config{
+		AuthModules: map[string]AuthModule{
+			"test": {User: "admin", Password: "admin"},
+		},
+	}}
+	all := newScrapers(0)
+
+	for _, tc := range []struct {
+		name string
+		url  string
+	}{
+		{"missing target", "/probe?auth_module=test"},
+		{"missing auth_module", "/probe?target=127.0.0.1:6032"},
+		{"unknown auth_module", "/probe?target=127.0.0.1:6032&auth_module=bogus"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+			rr := httptest.NewRecorder()
+
+			probeHandler(rr, req, sc, all, testLogger)
+
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("got status %d, want %d", rr.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2016-2017 Percona LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"os"
+)
+
+var (
+	logLevel = flag.String("log.level", "info",
+		"Only log messages with the given severity or above. One of: [debug, info, warn, error]")
+	logFormat = flag.String("log.format", "logfmt",
+		"Output format of log messages. One of: [logfmt, json]")
+)
+
+// newLogger builds the root *slog.Logger described by --log.level and
+// --log.format. This hand-rolls the same flags and slog handler selection
+// that github.com/prometheus/common/promslog provides, rather than depending
+// on promslog directly: the promslog version that ships in the currently
+// available prometheus/common requires Go 1.23+, while this module is pinned
+// to go 1.21.6. Switch to promslog once the module's Go floor can move past 1.23.
+func newLogger() *slog.Logger {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		level = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if *logFormat == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	return slog.New(handler)
+}
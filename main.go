@@ -0,0 +1,163 @@
+// Copyright 2016-2017 Percona LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	listenAddress = flag.String("web.listen-address", ":42004",
+		"Address to listen on for web interface and telemetry.")
+	metricsPath = flag.String("web.telemetry-path", "/metrics",
+		"Path under which to expose metrics.")
+	configFile = flag.String("config.file", "proxysql_exporter.yml",
+		"Path to the config file used to resolve /probe auth_modules.")
+
+	collectMySQLStatus = flag.Bool("collect.mysql_status", true,
+		"Collect from stats_mysql_global.")
+	collectMySQLConnectionPool = flag.Bool("collect.mysql_connection_pool", true,
+		"Collect from stats_mysql_connection_pool.")
+	collectMySQLConnectionList = flag.Bool("collect.mysql_connection_list", true,
+		"Collect connection list from stats_mysql_processlist.")
+	collectProcesslistDetail = flag.Bool("collect.processlist_detail", false,
+		"Collect per user/host/command/state thread counts from stats_mysql_processlist.")
+	processlistMinTime = flag.Int("collect.processlist_min_time", 0,
+		"Minimum thread elapsed time, in seconds, for --collect.processlist_detail to include it.")
+)
+
+func main() {
+	flag.Parse()
+	logger := newLogger()
+
+	sc := &SafeConfig{}
+	if err := sc.ReloadConfig(*configFile); err != nil {
+		logger.Warn("Error loading config file, /probe will be unavailable until it reloads successfully", "err", err)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := sc.ReloadConfig(*configFile); err != nil {
+				logger.Error("Error reloading config file", "err", err)
+				continue
+			}
+			logger.Info("Reloaded config file", "file", *configFile)
+		}
+	}()
+
+	allScrapers := newScrapers(*processlistMinTime)
+
+	if dsn := os.Getenv("DATA_SOURCE_NAME"); dsn != "" {
+		http.HandleFunc(*metricsPath, metricsHandler(dsn, allScrapers, logger))
+	}
+
+	http.HandleFunc("/probe", func(w http.ResponseWriter, r *http.Request) {
+		probeHandler(w, r, sc, allScrapers, logger)
+	})
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html>
+			<head><title>ProxySQL Exporter</title></head>
+			<body>
+			<h1>ProxySQL Exporter</h1>
+			<p><a href='` + *metricsPath + `'>Metrics</a></p>
+			<p><a href='/probe?target=127.0.0.1:6032&auth_module=example'>Example probe</a></p>
+			</body>
+			</html>`))
+	})
+
+	logger.Info("Listening", "address", *listenAddress)
+	if err := http.ListenAndServe(*listenAddress, nil); err != nil {
+		logger.Error("Server failed", "err", err)
+		os.Exit(1)
+	}
+}
+
+// defaultScrapers returns the scrapers enabled by the --collect.* flags.
+func defaultScrapers(all map[string]Scraper) []Scraper {
+	var enabled []Scraper
+	if *collectMySQLStatus {
+		enabled = append(enabled, all["mysql_status"])
+	}
+	if *collectMySQLConnectionPool {
+		enabled = append(enabled, all["mysql_connection_pool"])
+	}
+	if *collectMySQLConnectionList {
+		enabled = append(enabled, all["mysql_processlist"])
+	}
+	if *collectProcesslistDetail {
+		enabled = append(enabled, all["mysql_processlist_detail"])
+	}
+	return enabled
+}
+
+// metricsHandler serves /metrics for the single target configured via
+// DATA_SOURCE_NAME, honoring the collect[] URL parameter like mysqld_exporter does.
+// The underlying connection pool and Exporter (and its scrapes_total,
+// scrape_errors_total, etc. accounting) are built once and reused across
+// scrapes; only the scraper subset and timeout vary per request.
+func metricsHandler(dsn string, all map[string]Scraper, logger *slog.Logger) http.HandlerFunc {
+	defaults := defaultScrapers(all)
+
+	db, err := openDB(dsn)
+	if err != nil {
+		logger.Error("Error opening connection to ProxySQL", "err", err)
+		return func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Error opening connection to ProxySQL: "+err.Error(), http.StatusInternalServerError)
+		}
+	}
+	exporter := NewExporter(db, defaults, 0, logger)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		mc := metricsCollector{
+			exporter: exporter,
+			scrapers: filterScrapers(defaults, all, r.URL.Query()["collect[]"]),
+			timeout:  scrapeTimeout(r),
+		}
+
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(mc)
+
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	}
+}
+
+// metricsCollector scrapes a shared, long-lived Exporter with a possibly
+// request-specific scraper subset and timeout, so /metrics can honor
+// collect[] per request without resetting the Exporter's own scrape
+// accounting the way rebuilding the Exporter on every request would.
+type metricsCollector struct {
+	exporter *Exporter
+	scrapers []Scraper
+	timeout  time.Duration
+}
+
+func (mc metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	mc.exporter.Describe(ch)
+}
+
+func (mc metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	mc.exporter.CollectScrapers(ch, mc.scrapers, mc.timeout)
+}
@@ -0,0 +1,116 @@
+// Copyright 2016-2017 Percona LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	probeDurationDesc = prometheus.NewDesc(
+		"probe_duration_seconds",
+		"How long the probe took to complete, in seconds.",
+		nil, nil,
+	)
+	probeSuccessDesc = prometheus.NewDesc(
+		"probe_success",
+		"Whether the probe succeeded.",
+		nil, nil,
+	)
+)
+
+// probeCollector opens a connection to dsn and runs scrapers against it,
+// reporting probe_success and probe_duration_seconds alongside whatever
+// metrics the scrapers produced. Opening the connection is part of the timed,
+// collected scrape so a target that can't be reached still reports cleanly
+// instead of failing the whole request.
+type probeCollector struct {
+	dsn      string
+	scrapers []Scraper
+	timeout  time.Duration
+	logger   *slog.Logger
+}
+
+func (pc probeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- probeDurationDesc
+	ch <- probeSuccessDesc
+}
+
+func (pc probeCollector) Collect(ch chan<- prometheus.Metric) {
+	start := time.Now()
+
+	db, err := openDB(pc.dsn)
+	if err != nil {
+		pc.logger.Error("Error opening connection to ProxySQL", "err", err)
+		ch <- prometheus.MustNewConstMetric(probeDurationDesc, prometheus.GaugeValue, time.Since(start).Seconds())
+		ch <- prometheus.MustNewConstMetric(probeSuccessDesc, prometheus.GaugeValue, 0)
+		return
+	}
+	defer db.Close()
+
+	exporter := NewExporter(db, pc.scrapers, pc.timeout, pc.logger)
+	exporter.Collect(ch)
+
+	success := 1.0
+	if exporter.Error() {
+		success = 0
+	}
+	ch <- prometheus.MustNewConstMetric(probeDurationDesc, prometheus.GaugeValue, time.Since(start).Seconds())
+	ch <- prometheus.MustNewConstMetric(probeSuccessDesc, prometheus.GaugeValue, success)
+}
+
+// probeHandler serves /probe?target=host:port&auth_module=name, building a
+// fresh Exporter for the requested target and running it against a
+// scrape-scoped Registry, so a single exporter process can be pointed at any
+// number of ProxySQL admin interfaces via Prometheus relabeling.
+func probeHandler(w http.ResponseWriter, r *http.Request, sc *SafeConfig, all map[string]Scraper, logger *slog.Logger) {
+	params := r.URL.Query()
+
+	target := params.Get("target")
+	if target == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+
+	authModule := params.Get("auth_module")
+	if authModule == "" {
+		http.Error(w, "auth_module parameter is missing", http.StatusBadRequest)
+		return
+	}
+
+	dsn, err := sc.DSN(authModule, target)
+	if err != nil {
+		logger.Error("Error resolving auth_module", "auth_module", authModule, "target", target, "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pc := probeCollector{
+		dsn:      dsn,
+		scrapers: filterScrapers(defaultScrapers(all), all, params["collect[]"]),
+		timeout:  scrapeTimeout(r),
+		logger:   logger,
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(pc)
+
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
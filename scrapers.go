@@ -0,0 +1,97 @@
+// Copyright 2016-2017 Percona LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Scraper collects a named subset of ProxySQL metrics, so a scrape can opt in
+// or out of it via the collect[] URL parameter.
+type Scraper interface {
+	// Name is the value collect[] selects this scraper by.
+	Name() string
+	// Scrape collects metrics from db and sends them on ch.
+	Scrape(ctx context.Context, db *sql.DB, ch chan<- prometheus.Metric, logger *slog.Logger) error
+}
+
+// scraperMySQLStatus collects from stats_mysql_global.
+type scraperMySQLStatus struct{}
+
+func (scraperMySQLStatus) Name() string { return "mysql_status" }
+func (scraperMySQLStatus) Scrape(ctx context.Context, db *sql.DB, ch chan<- prometheus.Metric, logger *slog.Logger) error {
+	return scrapeMySQLGlobal(ctx, db, ch, logger)
+}
+
+// scraperMySQLConnectionPool collects from stats_mysql_connection_pool.
+type scraperMySQLConnectionPool struct{}
+
+func (scraperMySQLConnectionPool) Name() string { return "mysql_connection_pool" }
+func (scraperMySQLConnectionPool) Scrape(ctx context.Context, db *sql.DB, ch chan<- prometheus.Metric, logger *slog.Logger) error {
+	return scrapeMySQLConnectionPool(ctx, db, ch, logger)
+}
+
+// scraperMySQLProcesslist collects from stats_mysql_processlist.
+type scraperMySQLProcesslist struct{}
+
+func (scraperMySQLProcesslist) Name() string { return "mysql_processlist" }
+func (scraperMySQLProcesslist) Scrape(ctx context.Context, db *sql.DB, ch chan<- prometheus.Metric, logger *slog.Logger) error {
+	return scrapeMySQLConnectionList(ctx, db, ch, logger)
+}
+
+// scraperMySQLProcesslistDetail collects aggregated thread counts from
+// stats_mysql_processlist, excluding threads whose elapsed time is below minTime.
+type scraperMySQLProcesslistDetail struct {
+	minTime int
+}
+
+func (scraperMySQLProcesslistDetail) Name() string { return "mysql_processlist_detail" }
+func (s scraperMySQLProcesslistDetail) Scrape(ctx context.Context, db *sql.DB, ch chan<- prometheus.Metric, logger *slog.Logger) error {
+	return scrapeMySQLProcesslistDetail(ctx, db, ch, logger, s.minTime)
+}
+
+// newScrapers builds the set of every Scraper implementation the exporter
+// knows about, keyed by the name collect[] selects it with. processlistMinTime
+// is threaded into scraperMySQLProcesslistDetail explicitly, the same way ctx,
+// db, ch and logger are threaded through Scrape, rather than read from a
+// package-level flag variable at scrape time.
+func newScrapers(processlistMinTime int) map[string]Scraper {
+	return map[string]Scraper{
+		"mysql_status":             scraperMySQLStatus{},
+		"mysql_connection_pool":    scraperMySQLConnectionPool{},
+		"mysql_processlist":        scraperMySQLProcesslist{},
+		"mysql_processlist_detail": scraperMySQLProcesslistDetail{minTime: processlistMinTime},
+	}
+}
+
+// filterScrapers returns the Scraper for each requested name, ignoring names
+// that don't match a known scraper. If requested is empty, defaults is returned.
+func filterScrapers(defaults []Scraper, all map[string]Scraper, requested []string) []Scraper {
+	if len(requested) == 0 {
+		return defaults
+	}
+
+	filtered := make([]Scraper, 0, len(requested))
+	for _, name := range requested {
+		if s, ok := all[name]; ok {
+			filtered = append(filtered, s)
+		}
+	}
+	return filtered
+}